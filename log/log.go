@@ -0,0 +1,79 @@
+// Package log provides a small leveled logger used throughout sparse-tools.
+// It wraps the standard library logger with a simple level filter so that
+// verbose Trace/Debug output can be enabled only while diagnosing a specific
+// sync session.
+package log
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Level controls which messages are emitted.
+type Level int
+
+// Logging levels, from least to most verbose.
+const (
+	LevelError Level = iota
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var (
+	logger     = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+	levelStack = []Level{LevelInfo}
+)
+
+func currentLevel() Level {
+	return levelStack[len(levelStack)-1]
+}
+
+// LevelPush temporarily switches the active logging level. Pair with
+// LevelPop (typically via defer) to restore the previous level.
+func LevelPush(level Level) {
+	levelStack = append(levelStack, level)
+}
+
+// LevelPop restores the logging level in effect before the matching
+// LevelPush.
+func LevelPop() {
+	if len(levelStack) > 1 {
+		levelStack = levelStack[:len(levelStack)-1]
+	}
+}
+
+func output(level Level, prefix string, args ...interface{}) {
+	if level > currentLevel() {
+		return
+	}
+	logger.Output(3, prefix+fmt.Sprintln(args...))
+}
+
+// Trace logs the most verbose, per-block diagnostic messages.
+func Trace(args ...interface{}) {
+	output(LevelTrace, "TRACE ", args...)
+}
+
+// Debug logs per-extent diagnostic messages.
+func Debug(args ...interface{}) {
+	output(LevelDebug, "DEBUG ", args...)
+}
+
+// Info logs high level progress messages.
+func Info(args ...interface{}) {
+	output(LevelInfo, "INFO ", args...)
+}
+
+// Error logs a recoverable error.
+func Error(args ...interface{}) {
+	output(LevelError, "ERROR ", args...)
+}
+
+// Fatal logs an unrecoverable error and terminates the process, mirroring
+// the standard library's log.Fatal.
+func Fatal(args ...interface{}) {
+	logger.Output(3, "FATAL "+fmt.Sprintln(args...))
+	os.Exit(1)
+}
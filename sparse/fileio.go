@@ -0,0 +1,86 @@
+package sparse
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// openDestination opens name for read/write, creating it (and any missing
+// parent directories, since e.g. SyncTree names destinations nested under
+// directories the server has never seen before) if necessary, and ensures
+// it is exactly size bytes long. An existing file is truncated (or
+// extended) in place rather than recreated, since SyncFile is expected to
+// reconcile an already-present destination with the source rather than
+// starting from scratch.
+func openDestination(name string, size int64) (*os.File, error) {
+	if dir := filepath.Dir(name); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// DefaultHoleThreshold is the zero-run length, in bytes, at and above which
+// WriteSparse punches a hole instead of writing zeros. It matches the
+// common filesystem block size so that a hole can actually be realized.
+const DefaultHoleThreshold = Blocks
+
+// WriteSparse writes data at offset in f, but any run of zero bytes at
+// least holeThreshold bytes long is punched out as a hole instead of being
+// written. This lets a receiver land a sparse destination file even when
+// the sender streams data as a single dense buffer with no layout
+// information of its own (e.g. a dense source image with implicit zero
+// regions). A holeThreshold <= 0 selects DefaultHoleThreshold.
+func WriteSparse(f *os.File, offset int64, data []byte, holeThreshold int) error {
+	if holeThreshold <= 0 {
+		holeThreshold = DefaultHoleThreshold
+	}
+
+	// zeroRunAt returns the length of the run of zero bytes starting at
+	// pos (0 if data[pos] != 0).
+	zeroRunAt := func(pos int) int {
+		end := pos
+		for end < len(data) && data[end] == 0 {
+			end++
+		}
+		return end - pos
+	}
+
+	pos := 0
+	for pos < len(data) {
+		if run := zeroRunAt(pos); run >= holeThreshold {
+			if err := punchHole(f, offset+int64(pos), int64(run)); err != nil {
+				return err
+			}
+			pos += run
+			continue
+		}
+
+		// Accumulate a write run spanning non-zero bytes and any zero
+		// runs too short to be worth punching, up to the next qualifying
+		// hole (or the end of data).
+		writeStart := pos
+		for pos < len(data) {
+			if run := zeroRunAt(pos); run >= holeThreshold {
+				break
+			} else if run > 0 {
+				pos += run
+			} else {
+				pos++
+			}
+		}
+		if _, err := f.WriteAt(data[writeStart:pos], offset+int64(writeStart)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package sparse
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE and FALLOC_FL_PUNCH_HOLE are not exposed by the
+// standard syscall package on Linux (they live in golang.org/x/sys/unix,
+// which this module does not depend on), so their values are reproduced
+// here from linux/falloc.h.
+const (
+	flagKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	flagPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// punchHole discards any storage backing [offset, offset+length) in file,
+// replacing it with a hole while leaving the file size untouched.
+func punchHole(file *os.File, offset, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(file.Fd()), flagPunchHole|flagKeepSize, offset, length)
+}
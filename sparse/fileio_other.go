@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sparse
+
+import "os"
+
+// punchHole is a no-op on platforms without fallocate(2) hole punching;
+// the region is left as whatever it already contained.
+func punchHole(file *os.File, offset, length int64) error {
+	return nil
+}
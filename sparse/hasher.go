@@ -0,0 +1,78 @@
+package sparse
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+)
+
+// Hasher is a pluggable checksum algorithm SyncFile and VerifyFile use to
+// confirm that data landed on the destination intact.
+type Hasher interface {
+	// New returns a fresh hash.Hash instance for the algorithm.
+	New() hash.Hash
+	// Name identifies the algorithm on the wire, so the two ends of a
+	// session agree on which one they're using.
+	Name() string
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) New() hash.Hash { return sha256.New() }
+func (sha256Hasher) Name() string   { return "sha256" }
+
+type blake3Hasher struct{}
+
+func (blake3Hasher) New() hash.Hash { return blake3.New(sha256.Size, nil) }
+func (blake3Hasher) Name() string   { return "blake3" }
+
+type xxh3Hasher struct{}
+
+func (xxh3Hasher) New() hash.Hash { return xxh3.New() }
+func (xxh3Hasher) Name() string   { return "xxh3" }
+
+// DefaultHasher is used whenever a sync or verify session doesn't name a
+// specific algorithm.
+var DefaultHasher Hasher = sha256Hasher{}
+
+var hashers = map[string]Hasher{
+	"sha256": sha256Hasher{},
+	"blake3": blake3Hasher{},
+	"xxh3":   xxh3Hasher{},
+}
+
+// RegisterHasher makes a Hasher available to LookupHasher under its Name,
+// so callers outside this package can plug in additional algorithms.
+func RegisterHasher(h Hasher) {
+	hashers[h.Name()] = h
+}
+
+// LookupHasher returns the registered Hasher with the given name.
+func LookupHasher(name string) (Hasher, bool) {
+	h, ok := hashers[name]
+	return h, ok
+}
+
+func hasherOrDefault(name string) Hasher {
+	if h, ok := LookupHasher(name); ok {
+		return h
+	}
+	return DefaultHasher
+}
+
+// IntegrityError reports that the bytes found at [Offset, Offset+Length)
+// did not hash to what was expected.
+type IntegrityError struct {
+	Offset   int64
+	Length   int64
+	Expected []byte
+	Got      []byte
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("sparse: integrity check failed at offset %d, length %d: expected %x, got %x",
+		e.Offset, e.Length, e.Expected, e.Got)
+}
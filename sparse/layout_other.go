@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sparse
+
+import "os"
+
+// RetrieveLayout falls back to reporting the whole interval as a single
+// data extent on platforms without SEEK_DATA/SEEK_HOLE support.
+func RetrieveLayout(file *os.File, interval Interval) ([]FileInterval, error) {
+	if interval.Len() == 0 {
+		return nil, nil
+	}
+	return []FileInterval{{SparseData, interval}}, nil
+}
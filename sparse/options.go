@@ -0,0 +1,242 @@
+package sparse
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/sparse-tools/log"
+)
+
+// SyncOptions configures a SyncFileWithOptions session. The zero value
+// disables both progress reporting and rate limiting, and syncs the same
+// way SyncFile does.
+type SyncOptions struct {
+	// Mode selects the sync strategy, as with SyncFile (SyncModeLayout) and
+	// SyncFileBlockDiff (SyncModeBlockHash). Resume and verify sessions have
+	// their own entry points and are not driven through SyncOptions.
+	Mode SyncMode
+	// BlockSize is the block granularity used when Mode is
+	// SyncModeBlockHash. A value <= 0 selects defaultBlockSize.
+	BlockSize int64
+
+	// ProgressFunc, if non-nil, is called after each extent (or, in
+	// SyncModeBlockHash, each retransmitted block) crosses the wire, with
+	// the running totals for the session so far.
+	ProgressFunc func(bytesSent, bytesSkipped, totalBytes int64)
+
+	// MaxBytesPerSec caps the rate at which data extents are written to the
+	// connection, smoothing out bursts that would otherwise starve
+	// foreground I/O sharing the same link. A value <= 0 means unlimited.
+	MaxBytesPerSec int64
+}
+
+// SyncStats summarizes the outcome of a SyncFileWithOptions call.
+type SyncStats struct {
+	// DataSent is the number of data bytes actually transferred to the
+	// server, as opposed to the total size of the file being synced.
+	DataSent int64
+	// HolesSkipped is the number of bytes that fell within hole extents and
+	// so were punched out on the destination rather than transferred.
+	HolesSkipped int64
+	// DedupSkipped is the number of bytes that SyncModeBlockHash found
+	// already present on the destination and so did not retransmit.
+	DedupSkipped int64
+	// Elapsed is how long the session took, from dial to final ack.
+	Elapsed time.Duration
+}
+
+// SyncFileWithOptions synchronizes remoteName with localName like SyncFile,
+// but accepts a SyncOptions for live progress reporting and optional
+// bandwidth limiting - useful for callers (e.g. an orchestrator replicating
+// a volume in the background) that need to cap how much of the link a sync
+// session consumes and report its progress as it runs.
+func SyncFileWithOptions(localName string, addr TCPEndPoint, remoteName string, timeout int, opts SyncOptions) (SyncStats, error) {
+	start := time.Now()
+
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+
+	src, err := os.Open(localName)
+	if err != nil {
+		return SyncStats{}, err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return SyncStats{}, err
+	}
+	size := fi.Size()
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Duration(timeout)*time.Second)
+	if err != nil {
+		return SyncStats{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	var w io.Writer = conn
+	if opts.MaxBytesPerSec > 0 {
+		w = newRateLimitedWriter(conn, opts.MaxBytesPerSec)
+	}
+	enc := gob.NewEncoder(w)
+	dec := gob.NewDecoder(conn)
+
+	if err := enc.Encode(syncRequest{Name: remoteName, Size: size, Mode: opts.Mode, BlockSize: blockSize, ModTime: fi.ModTime(), HasherName: DefaultHasher.Name()}); err != nil {
+		return SyncStats{}, err
+	}
+
+	layout, err := RetrieveLayout(src, Interval{0, size})
+	if err != nil {
+		return SyncStats{}, err
+	}
+
+	var info SyncInfo
+	var stats SyncStats
+	report := func() {
+		if opts.ProgressFunc != nil {
+			opts.ProgressFunc(stats.DataSent, stats.HolesSkipped+stats.DedupSkipped, size)
+		}
+	}
+
+	switch opts.Mode {
+	case SyncModeBlockHash:
+		err = clientBlockHashSync(src, layout, blockSize, enc, dec, &info, func(offset, n int64) {
+			stats.DataSent += n
+			report()
+		})
+		if err == nil {
+			var dataTotal int64
+			for _, extent := range layout {
+				if extent.Kind == SparseData {
+					dataTotal += extent.Len()
+				} else {
+					stats.HolesSkipped += extent.Len()
+				}
+			}
+			stats.DedupSkipped = dataTotal - stats.DataSent
+			report()
+		}
+	default:
+		err = clientLayoutSync(src, layout, enc, &info, func(extent FileInterval) {
+			if extent.Kind == SparseHole {
+				stats.HolesSkipped += extent.Len()
+			} else {
+				stats.DataSent = info.BytesSent
+			}
+			report()
+		})
+	}
+	if err != nil {
+		stats.Elapsed = time.Since(start)
+		return stats, err
+	}
+
+	var ack extentMsg
+	if err := dec.Decode(&ack); err != nil {
+		stats.Elapsed = time.Since(start)
+		return stats, err
+	}
+	stats.Elapsed = time.Since(start)
+	if ack.Integrity != nil {
+		return stats, ack.Integrity
+	}
+	if !ack.Done {
+		return stats, fmt.Errorf("sparse: unexpected server response")
+	}
+
+	log.Info("sync done: ", localName, " -> ", addr, ":", remoteName,
+		" sent=", humanizeBytes(stats.DataSent),
+		" skipped=", humanizeBytes(stats.HolesSkipped+stats.DedupSkipped),
+		" in ", stats.Elapsed)
+	return stats, nil
+}
+
+// rateLimitedWriter wraps an io.Writer, sleeping as needed so that writes
+// through it average no more than ratePerSec bytes per second. It is a
+// simple token bucket: tokens accumulate at ratePerSec and a write consumes
+// tokens equal to its length, blocking until enough are available.
+type rateLimitedWriter struct {
+	w    io.Writer
+	rate int64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimitedWriter(w io.Writer, ratePerSec int64) *rateLimitedWriter {
+	return &rateLimitedWriter{w: w, rate: ratePerSec, tokens: float64(ratePerSec), last: time.Now()}
+}
+
+// Write hands p to the underlying writer in slices of at most rate bytes,
+// since the bucket never holds more than one second's worth of tokens and
+// a single write larger than that would otherwise block on take forever.
+func (r *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > r.rate {
+			chunk = chunk[:r.rate]
+		}
+		r.take(int64(len(chunk)))
+		n, err := r.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// take blocks until n tokens (bytes) are available, refilling the bucket
+// based on how much time has passed since the last call. The bucket never
+// holds more than one second's worth of tokens, so a session that has been
+// idle can't "catch up" into an unthrottled burst. Callers must keep n
+// within that ceiling (Write does, by chunking).
+func (r *rateLimitedWriter) take(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		now := time.Now()
+		r.tokens += now.Sub(r.last).Seconds() * float64(r.rate)
+		r.last = now
+		if r.tokens > float64(r.rate) {
+			r.tokens = float64(r.rate)
+		}
+
+		if r.tokens >= float64(n) {
+			r.tokens -= float64(n)
+			return
+		}
+
+		wait := time.Duration(float64(time.Second) * (float64(n) - r.tokens) / float64(r.rate))
+		r.mu.Unlock()
+		time.Sleep(wait)
+		r.mu.Lock()
+	}
+}
+
+// humanizeBytes formats n as a short, human-readable size (e.g. "1.5MB"),
+// for use in log messages.
+func humanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
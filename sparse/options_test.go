@@ -0,0 +1,103 @@
+package sparse_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	. "github.com/rancher/sparse-tools/sparse"
+)
+
+func TestSyncFileWithOptionsReportsProgress(t *testing.T) {
+	const localhost = "127.0.0.1"
+	const timeout = 10 //seconds
+	remoteAddr := TCPEndPoint{localhost, 5007}
+
+	const size = 2 /*MB*/ << 20
+	srcName := tempFileName("ssync-options-src")
+	dstName := tempFileName("ssync-options-dst")
+	defer os.Remove(srcName)
+	defer os.Remove(dstName)
+
+	content := make([]byte, size)
+	rand.New(rand.NewSource(11)).Read(content)
+	if err := ioutil.WriteFile(srcName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dstName, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	var lastSent, lastTotal int64
+	opts := SyncOptions{
+		Mode: SyncModeLayout,
+		ProgressFunc: func(bytesSent, bytesSkipped, totalBytes int64) {
+			calls++
+			lastSent = bytesSent
+			lastTotal = totalBytes
+		},
+	}
+
+	go TestServer(remoteAddr, timeout)
+	stats, err := SyncFileWithOptions(srcName, remoteAddr, dstName, timeout, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 {
+		t.Fatal("expected ProgressFunc to be called at least once")
+	}
+	if lastTotal != size {
+		t.Fatalf("expected final progress totalBytes=%d, got %d", size, lastTotal)
+	}
+	if lastSent != stats.DataSent {
+		t.Fatalf("expected final progress bytesSent=%d to match stats.DataSent=%d", lastSent, stats.DataSent)
+	}
+	if stats.DataSent != size {
+		t.Fatalf("expected the whole dense file to be sent, got %d of %d", stats.DataSent, size)
+	}
+	if stats.Elapsed <= 0 {
+		t.Fatal("expected Elapsed to be recorded")
+	}
+
+	synced, err := ioutil.ReadFile(dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != size {
+		t.Fatalf("expected dst size %d, got %d", size, len(synced))
+	}
+}
+
+func TestSyncFileWithOptionsRateLimited(t *testing.T) {
+	const localhost = "127.0.0.1"
+	const timeout = 10 //seconds
+	remoteAddr := TCPEndPoint{localhost, 5008}
+
+	const size = 512 << 10 // 512KB
+	srcName := tempFileName("ssync-options-rl-src")
+	dstName := tempFileName("ssync-options-rl-dst")
+	defer os.Remove(srcName)
+	defer os.Remove(dstName)
+
+	content := make([]byte, size)
+	rand.New(rand.NewSource(13)).Read(content)
+	if err := ioutil.WriteFile(srcName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dstName, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := SyncOptions{Mode: SyncModeLayout, MaxBytesPerSec: 256 << 10} // 512KB at 256KB/s: the bucket starts full, so about one second of throttling
+
+	go TestServer(remoteAddr, timeout)
+	stats, err := SyncFileWithOptions(srcName, remoteAddr, dstName, timeout, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Elapsed <= 0 {
+		t.Fatal("expected Elapsed to be recorded")
+	}
+}
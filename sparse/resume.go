@@ -0,0 +1,276 @@
+package sparse
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rancher/sparse-tools/log"
+)
+
+// journalVersion identifies the encoding of the progress journal so a
+// future format change can detect and discard an incompatible journal
+// rather than misinterpreting it.
+const journalVersion = 1
+
+// journalSuffix is appended to the destination file name to name its
+// progress journal sidecar.
+const journalSuffix = ".ssync-progress"
+
+// journalRecord confirms that the destination bytes in [Offset, End) are
+// known to match the source's, as of Hash.
+type journalRecord struct {
+	Offset int64
+	End    int64
+	Hash   [sha256.Size]byte
+}
+
+type syncJournal struct {
+	Version int
+	Records []journalRecord
+}
+
+func journalPath(dstName string) string {
+	return dstName + journalSuffix
+}
+
+// loadJournal reads a destination's progress journal, returning an empty
+// one if none exists yet or if it was written by an incompatible version.
+func loadJournal(dstName string) (syncJournal, error) {
+	f, err := os.Open(journalPath(dstName))
+	if os.IsNotExist(err) {
+		return syncJournal{Version: journalVersion}, nil
+	}
+	if err != nil {
+		return syncJournal{}, err
+	}
+	defer f.Close()
+
+	var j syncJournal
+	if err := gob.NewDecoder(f).Decode(&j); err != nil {
+		return syncJournal{Version: journalVersion}, nil
+	}
+	if j.Version != journalVersion {
+		return syncJournal{Version: journalVersion}, nil
+	}
+	return j, nil
+}
+
+// saveJournal durably persists j next to dstName, via a temp-file-and-
+// rename so a crash mid-write can't leave a corrupt journal behind.
+func saveJournal(dstName string, j syncJournal) error {
+	path := journalPath(dstName)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(j); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeJournal discards the progress journal once a sync session has
+// completed in full and it is no longer needed.
+func removeJournal(dstName string) error {
+	err := os.Remove(journalPath(dstName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// verifyJournal re-hashes each journal record's byte range in dst and
+// keeps only the records that still match, since the destination may have
+// been modified or truncated since the journal was written.
+func verifyJournal(dst *os.File, j syncJournal) []journalRecord {
+	var valid []journalRecord
+	for _, rec := range j.Records {
+		buf := make([]byte, rec.End-rec.Offset)
+		if _, err := dst.ReadAt(buf, rec.Offset); err != nil {
+			continue
+		}
+		if sha256.Sum256(buf) == rec.Hash {
+			valid = append(valid, rec)
+		}
+	}
+	return valid
+}
+
+// resumeStateMsg tells the client which extents the server has already
+// confirmed it holds, so the client can skip retransmitting them.
+type resumeStateMsg struct {
+	Confirmed []Interval
+}
+
+// ResumeSyncFile behaves like SyncFile, but maintains a progress journal
+// (dstName+".ssync-progress") as it goes. If a prior session was
+// interrupted partway through, a subsequent ResumeSyncFile call re-hashes
+// the extents the journal says were already written, confirms they are
+// still intact, and skips retransmitting them - only the remainder of the
+// file crosses the wire. The journal is removed once a session completes
+// in full.
+func ResumeSyncFile(localName string, addr TCPEndPoint, remoteName string, timeout int) (SyncInfo, error) {
+	var info SyncInfo
+
+	src, err := os.Open(localName)
+	if err != nil {
+		return info, err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return info, err
+	}
+	size := fi.Size()
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Duration(timeout)*time.Second)
+	if err != nil {
+		return info, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	if err := enc.Encode(syncRequest{Name: remoteName, Size: size, Mode: SyncModeResume, ModTime: fi.ModTime()}); err != nil {
+		return info, err
+	}
+
+	var state resumeStateMsg
+	if err := dec.Decode(&state); err != nil {
+		return info, err
+	}
+
+	layout, err := RetrieveLayout(src, Interval{0, size})
+	if err != nil {
+		return info, err
+	}
+	layout = skipConfirmed(layout, state.Confirmed)
+
+	if err := clientLayoutSync(src, layout, enc, &info, nil); err != nil {
+		return info, err
+	}
+
+	var ack extentMsg
+	if err := dec.Decode(&ack); err != nil {
+		return info, err
+	}
+
+	log.Info("resumable sync done: ", localName, " -> ", addr, ":", remoteName, " resumed bytes skipped, sent=", info.BytesSent)
+	return info, nil
+}
+
+// skipConfirmed carves the portions of each data extent that overlap a
+// server-confirmed interval out of the layout, since those bytes are
+// already known to be correct on the destination. Confirmed intervals are
+// journaled at syncChunkSize granularity, so they rarely line up exactly
+// with RetrieveLayout's (much coarser) extent boundaries; the remainder of
+// a partially-confirmed extent is still retransmitted as its own data
+// extent. Hole extents always pass through, since punching a hole is cheap
+// and idempotent.
+func skipConfirmed(layout []FileInterval, confirmed []Interval) []FileInterval {
+	if len(confirmed) == 0 {
+		return layout
+	}
+	sorted := append([]Interval(nil), confirmed...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Begin < sorted[j].Begin })
+
+	filtered := layout[:0:0]
+	for _, extent := range layout {
+		if extent.Kind != SparseData {
+			filtered = append(filtered, extent)
+			continue
+		}
+		filtered = append(filtered, unconfirmedParts(extent.Interval, sorted)...)
+	}
+	return filtered
+}
+
+// unconfirmedParts returns the sub-ranges of extent that are not covered by
+// any interval in sorted (which must be sorted by Begin), each as its own
+// SparseData extent.
+func unconfirmedParts(extent Interval, sorted []Interval) []FileInterval {
+	var out []FileInterval
+	pos := extent.Begin
+	for _, iv := range sorted {
+		if iv.End <= pos || iv.Begin >= extent.End {
+			continue
+		}
+		if iv.Begin > pos {
+			out = append(out, FileInterval{Kind: SparseData, Interval: Interval{pos, iv.Begin}})
+		}
+		if iv.End > pos {
+			pos = iv.End
+		}
+	}
+	if pos < extent.End {
+		out = append(out, FileInterval{Kind: SparseData, Interval: Interval{pos, extent.End}})
+	}
+	return out
+}
+
+// serveResumeSync is the server side of SyncModeResume: it confirms
+// whatever the journal says is already correct, accepts the rest of the
+// extents the client still sends, and journals each one as it lands so
+// that a later reconnect can resume from here.
+func serveResumeSync(dst *os.File, enc *gob.Encoder, dec *gob.Decoder) error {
+	dstName := dst.Name()
+
+	j, err := loadJournal(dstName)
+	if err != nil {
+		return err
+	}
+	j.Records = verifyJournal(dst, j)
+
+	confirmed := make([]Interval, len(j.Records))
+	for i, rec := range j.Records {
+		confirmed[i] = Interval{rec.Offset, rec.End}
+	}
+	if err := enc.Encode(resumeStateMsg{Confirmed: confirmed}); err != nil {
+		return err
+	}
+
+	for {
+		var msg extentMsg
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Done {
+			break
+		}
+		if err := applyExtent(dst, msg); err != nil {
+			return err
+		}
+		if msg.Extent.Kind == SparseData {
+			j.Records = append(j.Records, journalRecord{
+				Offset: msg.Extent.Begin,
+				End:    msg.Extent.End,
+				Hash:   sha256.Sum256(msg.Data),
+			})
+			if err := saveJournal(dstName, j); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	return removeJournal(dstName)
+}
@@ -0,0 +1,106 @@
+package sparse_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+
+	. "github.com/rancher/sparse-tools/sparse"
+)
+
+// killAfter proxies a single connection from listenAddr to backendAddr,
+// forwarding at most limit bytes from the client before severing both
+// ends of the connection. It is used to deterministically simulate a
+// session dying partway through a transfer.
+func killAfter(t *testing.T, listenAddr TCPEndPoint, backendAddr TCPEndPoint, limit int64) {
+	l, err := net.Listen("tcp", listenAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+		front, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer front.Close()
+
+		back, err := net.Dial("tcp", backendAddr.String())
+		if err != nil {
+			return
+		}
+		defer back.Close()
+
+		go io.Copy(front, back) // server -> client: unrestricted
+		io.CopyN(back, front, limit) // client -> server: cut off after limit bytes
+	}()
+}
+
+// TestResumeSyncFileAfterBrokenConnection verifies that a ResumeSyncFile
+// session interrupted partway through can be resumed, and that the resumed
+// session only retransmits the portion of the file not already confirmed
+// durable on the destination.
+func TestResumeSyncFileAfterBrokenConnection(t *testing.T) {
+	const localhost = "127.0.0.1"
+	const timeout = 10 //seconds
+	backendAddr := TCPEndPoint{localhost, 5003}
+	proxyAddr := TCPEndPoint{localhost, 5004}
+
+	const size = 6 /*MB*/ << 20
+	srcName := tempFileName("ssync-resume-src")
+	dstName := tempFileName("ssync-resume-dst")
+	defer os.Remove(srcName)
+	defer os.Remove(dstName)
+	defer os.Remove(dstName + ".ssync-progress")
+
+	content := make([]byte, size)
+	rand.New(rand.NewSource(7)).Read(content)
+	if err := ioutil.WriteFile(srcName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dstName, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// First attempt: severed partway through by the proxy. Wait for this
+	// TestServer to return (and so release its listener) before starting
+	// the next one on the same port, or the second Listen can lose the
+	// port race and the client ends up accepted into the stale listener.
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		TestServer(backendAddr, timeout)
+	}()
+	killAfter(t, proxyAddr, backendAddr, 2*1024*1024+4096)
+	if _, err := ResumeSyncFile(srcName, proxyAddr, dstName, timeout); err == nil {
+		t.Fatal("expected the interrupted sync to fail")
+	}
+	<-firstDone
+
+	// Second attempt: a direct, uninterrupted connection should resume
+	// from the journal and finish.
+	go TestServer(backendAddr, timeout)
+	info, err := ResumeSyncFile(srcName, backendAddr, dstName, timeout)
+	if err != nil {
+		t.Fatal("resumed sync error", err)
+	}
+	if info.BytesSent >= size {
+		t.Fatalf("resumed sync retransmitted the whole file (%d bytes); expected confirmed extents to be skipped", info.BytesSent)
+	}
+
+	synced, err := ioutil.ReadFile(dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(synced, content) {
+		t.Fatal("dst content does not match src after resumed sync")
+	}
+	if _, err := os.Stat(dstName + ".ssync-progress"); !os.IsNotExist(err) {
+		t.Fatal("progress journal should be removed once the sync completes")
+	}
+}
@@ -0,0 +1,515 @@
+package sparse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/rancher/sparse-tools/log"
+)
+
+// syncChunkSize bounds how much data extent content is buffered in memory
+// at once while streaming a sync session.
+const syncChunkSize = 1 << 20 // 1MB
+
+// defaultBlockSize is the block granularity used by SyncModeBlockHash when
+// the caller does not request a different size.
+const defaultBlockSize = 128 << 10 // 128KB
+
+// SyncMode selects the strategy SyncFile uses to decide which bytes
+// actually need to cross the wire.
+type SyncMode int
+
+const (
+	// SyncModeLayout transfers every data extent reported by the source's
+	// sparse layout, relying on hole/data boundaries alone to skip zeros.
+	// This is the original, simplest sync strategy.
+	SyncModeLayout SyncMode = iota
+
+	// SyncModeBlockHash additionally splits each data extent into
+	// fixed-size blocks, hashes them on both ends, and only transfers the
+	// blocks whose hashes differ. This trades a hashing pass for
+	// potentially much less network traffic when most of a data extent is
+	// already present on the destination (e.g. incremental VM image sync).
+	SyncModeBlockHash
+
+	// SyncModeResume behaves like SyncModeLayout, but consults and updates
+	// a progress journal alongside the destination so that a session
+	// broken by a connection failure can pick up where it left off
+	// instead of starting over. See ResumeSyncFile.
+	SyncModeResume
+
+	// SyncModeVerify never writes to the destination; it only compares
+	// hashes of the source's data extents against the same ranges on the
+	// destination. See VerifyFile.
+	SyncModeVerify
+)
+
+// SyncInfo summarizes the outcome of a SyncFile call.
+type SyncInfo struct {
+	// Updated reports whether any bytes were written to the destination.
+	Updated bool
+	// BytesSent is the number of data bytes actually transferred to the
+	// server, as opposed to the total size of the file being synced.
+	BytesSent int64
+}
+
+type syncRequest struct {
+	Name       string
+	Size       int64
+	Mode       SyncMode
+	BlockSize  int64
+	ModTime    time.Time
+	HasherName string
+}
+
+// extentMsg streams a single extent from client to server. Extent.Kind ==
+// SparseHole messages carry no Data and tell the server to punch a hole
+// instead of writing bytes. The last chunk of a data extent carries the
+// hash of the whole extent (ExtentInterval, Hash), computed as the client
+// streamed it, so the server can confirm what actually landed on disk
+// rather than trusting the transfer blindly. The final message of a
+// session is a Done ack; Integrity is set on that ack if the server found
+// a mismatch.
+type extentMsg struct {
+	Done           bool
+	Extent         FileInterval
+	Data           []byte
+	LastChunk      bool
+	ExtentInterval Interval
+	Hash           []byte
+	Integrity      *IntegrityError
+}
+
+// blockHashMsg announces the hash of one fixed-size block of a data extent,
+// used during the SyncModeBlockHash hash-exchange phase.
+type blockHashMsg struct {
+	Done   bool
+	Offset int64
+	Size   int64
+	Hash   [sha256.Size]byte
+}
+
+// needMsg is the server's reply during SyncModeBlockHash, asking the client
+// to send the bytes for one block whose hash did not match.
+type needMsg struct {
+	Done   bool
+	Offset int64
+	Size   int64
+}
+
+// SyncFile synchronizes remoteName on the server listening at addr so that
+// it matches localName, transferring only data extents (holes are skipped
+// and punched out on the destination). timeout bounds both the dial and
+// the overall session, in seconds.
+func SyncFile(localName string, addr TCPEndPoint, remoteName string, timeout int) (SyncInfo, error) {
+	return syncFile(localName, addr, remoteName, timeout, SyncModeLayout, 0)
+}
+
+// SyncFileBlockDiff synchronizes remoteName with localName the same way
+// SyncFile does, but additionally hashes blockSize-sized blocks within each
+// data extent and transfers only the blocks whose hashes differ. Use this
+// when the destination is expected to already hold most of the source's
+// data (e.g. a previous, slightly stale copy), so that only the changed
+// regions need to cross the wire. A blockSize of 0 selects a sensible
+// default.
+func SyncFileBlockDiff(localName string, addr TCPEndPoint, remoteName string, timeout int, blockSize int64) (SyncInfo, error) {
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	return syncFile(localName, addr, remoteName, timeout, SyncModeBlockHash, blockSize)
+}
+
+func syncFile(localName string, addr TCPEndPoint, remoteName string, timeout int, mode SyncMode, blockSize int64) (SyncInfo, error) {
+	src, err := os.Open(localName)
+	if err != nil {
+		return SyncInfo{}, err
+	}
+	defer src.Close()
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Duration(timeout)*time.Second)
+	if err != nil {
+		return SyncInfo{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	info, err := syncFileSession(enc, dec, src, remoteName, mode, blockSize)
+	if err != nil {
+		return info, err
+	}
+
+	log.Info("sync done: ", localName, " -> ", addr, ":", remoteName, " updated=", info.Updated)
+	return info, nil
+}
+
+// syncFileSession runs the client side of one file's sync protocol over an
+// already-established connection. It is split out from syncFile so that
+// SyncTree can multiplex the same per-file protocol for many files over a
+// single TCP session instead of dialing once per file.
+func syncFileSession(enc *gob.Encoder, dec *gob.Decoder, src *os.File, remoteName string, mode SyncMode, blockSize int64) (SyncInfo, error) {
+	var info SyncInfo
+
+	fi, err := src.Stat()
+	if err != nil {
+		return info, err
+	}
+	size := fi.Size()
+
+	if err := enc.Encode(syncRequest{Name: remoteName, Size: size, Mode: mode, BlockSize: blockSize, ModTime: fi.ModTime(), HasherName: DefaultHasher.Name()}); err != nil {
+		return info, err
+	}
+
+	layout, err := RetrieveLayout(src, Interval{0, size})
+	if err != nil {
+		return info, err
+	}
+
+	switch mode {
+	case SyncModeBlockHash:
+		err = clientBlockHashSync(src, layout, blockSize, enc, dec, &info, nil)
+	default:
+		err = clientLayoutSync(src, layout, enc, &info, nil)
+	}
+	if err != nil {
+		return info, err
+	}
+
+	var ack extentMsg
+	if err := dec.Decode(&ack); err != nil {
+		return info, err
+	}
+	if ack.Integrity != nil {
+		return info, ack.Integrity
+	}
+	if !ack.Done {
+		return info, fmt.Errorf("sparse: unexpected server response")
+	}
+
+	return info, nil
+}
+
+// clientLayoutSync implements SyncModeLayout: every data extent is sent in
+// full, every hole extent tells the server to punch a hole. Each data
+// extent is hashed with DefaultHasher as it streams, so the server can
+// confirm what it wrote rather than trusting the transfer blindly.
+// onExtent, if non-nil, is called once per extent after it has been fully
+// sent, so callers such as SyncFileWithOptions can report progress at
+// extent boundaries.
+func clientLayoutSync(src *os.File, layout []FileInterval, enc *gob.Encoder, info *SyncInfo, onExtent func(FileInterval)) error {
+	for _, extent := range layout {
+		if extent.Kind == SparseHole {
+			if err := enc.Encode(extentMsg{Extent: extent}); err != nil {
+				return err
+			}
+			if onExtent != nil {
+				onExtent(extent)
+			}
+			continue
+		}
+
+		if err := streamExtentCounted(src, extent, enc, &info.BytesSent); err != nil {
+			return err
+		}
+		info.Updated = true
+		if onExtent != nil {
+			onExtent(extent)
+		}
+	}
+	return enc.Encode(extentMsg{Done: true})
+}
+
+// streamExtent sends a single data extent's bytes, split into
+// syncChunkSize pieces so memory use stays bounded regardless of file size.
+// The last chunk also carries the hash of the whole extent.
+func streamExtent(src *os.File, extent FileInterval, enc *gob.Encoder) error {
+	buf := make([]byte, syncChunkSize)
+	h := DefaultHasher.New()
+	for offset := extent.Begin; offset < extent.End; {
+		size := int64(len(buf))
+		if offset+size > extent.End {
+			size = extent.End - offset
+		}
+		chunk := buf[:size]
+		if _, err := src.ReadAt(chunk, offset); err != nil {
+			return err
+		}
+		h.Write(chunk)
+
+		msg := extentMsg{Extent: FileInterval{SparseData, Interval{offset, offset + size}}, Data: chunk}
+		offset += size
+		if offset >= extent.End {
+			msg.LastChunk = true
+			msg.ExtentInterval = extent.Interval
+			msg.Hash = h.Sum(nil)
+		}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamExtentCounted behaves like streamExtent but also accumulates the
+// number of bytes sent into *sent.
+func streamExtentCounted(src *os.File, extent FileInterval, enc *gob.Encoder, sent *int64) error {
+	if err := streamExtent(src, extent, enc); err != nil {
+		return err
+	}
+	*sent += extent.Len()
+	return nil
+}
+
+// clientBlockHashSync implements SyncModeBlockHash: hashes are exchanged
+// first, then only the blocks the server reports as mismatched are sent.
+// onSend, if non-nil, is called once per block actually retransmitted, so
+// callers such as SyncFileWithOptions can report progress as blocks go out.
+func clientBlockHashSync(src *os.File, layout []FileInterval, blockSize int64, enc *gob.Encoder, dec *gob.Decoder, info *SyncInfo, onSend func(offset, size int64)) error {
+	buf := make([]byte, blockSize)
+	for _, extent := range layout {
+		if extent.Kind == SparseHole {
+			if err := enc.Encode(blockHashMsg{Offset: extent.Begin, Size: -extent.Len()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for offset := extent.Begin; offset < extent.End; {
+			size := blockSize
+			if offset+size > extent.End {
+				size = extent.End - offset
+			}
+			block := buf[:size]
+			if _, err := src.ReadAt(block, offset); err != nil {
+				return err
+			}
+			if err := enc.Encode(blockHashMsg{Offset: offset, Size: size, Hash: sha256.Sum256(block)}); err != nil {
+				return err
+			}
+			offset += size
+		}
+	}
+	if err := enc.Encode(blockHashMsg{Done: true}); err != nil {
+		return err
+	}
+
+	for {
+		var need needMsg
+		if err := dec.Decode(&need); err != nil {
+			return err
+		}
+		if need.Done {
+			break
+		}
+
+		block := make([]byte, need.Size)
+		if _, err := src.ReadAt(block, need.Offset); err != nil {
+			return err
+		}
+		msg := extentMsg{Extent: FileInterval{SparseData, Interval{need.Offset, need.Offset + need.Size}}, Data: block}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		info.Updated = true
+		info.BytesSent += need.Size
+		if onSend != nil {
+			onSend(need.Offset, need.Size)
+		}
+	}
+
+	return enc.Encode(extentMsg{Done: true})
+}
+
+// TestServer accepts a single sync session at addr and applies it to
+// whatever destination file the client names, then returns. It exists to
+// exercise SyncFile end to end in tests; production deployments are
+// expected to run their own long-lived listener loop around the same
+// session handling.
+func TestServer(addr TCPEndPoint, timeout int) error {
+	l, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if tl, ok := l.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	return serveFileSession(enc, dec)
+}
+
+// serveFileSession runs the server side of one file's sync protocol over an
+// already-established connection. It is split out from TestServer so that
+// TestTreeServer can multiplex it across the files of a SyncTree session
+// sharing a single connection.
+func serveFileSession(enc *gob.Encoder, dec *gob.Decoder) error {
+	var req syncRequest
+	if err := dec.Decode(&req); err != nil {
+		return err
+	}
+
+	var dst *os.File
+	var err error
+	if req.Mode == SyncModeVerify {
+		dst, err = os.Open(req.Name)
+	} else {
+		dst, err = openDestination(req.Name, req.Size)
+	}
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	switch req.Mode {
+	case SyncModeBlockHash:
+		err = serveBlockHashSync(dst, req.BlockSize, enc, dec)
+	case SyncModeResume:
+		err = serveResumeSync(dst, enc, dec)
+	case SyncModeVerify:
+		err = serveVerifySync(dst, req.Size, hasherOrDefault(req.HasherName), dec)
+	default:
+		err = serveLayoutSync(dst, hasherOrDefault(req.HasherName), dec)
+	}
+	if err != nil {
+		if integrity, ok := err.(*IntegrityError); ok {
+			enc.Encode(extentMsg{Done: true, Integrity: integrity})
+		}
+		return err
+	}
+
+	if req.Mode == SyncModeVerify {
+		return enc.Encode(extentMsg{Done: true})
+	}
+
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if !req.ModTime.IsZero() {
+		if err := os.Chtimes(req.Name, req.ModTime, req.ModTime); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(extentMsg{Done: true})
+}
+
+// serveLayoutSync applies each received extent to dst. Once a data
+// extent's last chunk arrives, it reads back what was just written and
+// confirms it hashes to what the client sent, returning an *IntegrityError
+// instead of silently trusting the transfer if it doesn't.
+func serveLayoutSync(dst *os.File, hasher Hasher, dec *gob.Decoder) error {
+	for {
+		var msg extentMsg
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Done {
+			return nil
+		}
+		if err := applyExtent(dst, msg); err != nil {
+			return err
+		}
+		if msg.Extent.Kind == SparseData && msg.LastChunk {
+			if err := verifyWritten(dst, hasher, msg.ExtentInterval, msg.Hash); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// verifyWritten re-reads [want.Begin, want.End) from dst and confirms it
+// hashes to expected.
+func verifyWritten(dst *os.File, hasher Hasher, want Interval, expected []byte) error {
+	buf := make([]byte, want.Len())
+	if _, err := dst.ReadAt(buf, want.Begin); err != nil {
+		return err
+	}
+	h := hasher.New()
+	h.Write(buf)
+	got := h.Sum(nil)
+	if !bytes.Equal(got, expected) {
+		return &IntegrityError{Offset: want.Begin, Length: want.Len(), Expected: expected, Got: got}
+	}
+	return nil
+}
+
+// applyExtent lands one received extent on dst. Data extents go through
+// WriteSparse rather than a plain WriteAt so that embedded zero runs the
+// sender didn't already know were sparse (e.g. a dense source image) still
+// land as real holes on the destination.
+func applyExtent(dst *os.File, msg extentMsg) error {
+	if msg.Extent.Kind == SparseHole {
+		return punchHole(dst, msg.Extent.Begin, msg.Extent.Len())
+	}
+	return WriteSparse(dst, msg.Extent.Begin, msg.Data, DefaultHoleThreshold)
+}
+
+// serveBlockHashSync receives the client's block hashes, compares each
+// against the corresponding block already on disk, and asks for only the
+// blocks that differ.
+func serveBlockHashSync(dst *os.File, blockSize int64, enc *gob.Encoder, dec *gob.Decoder) error {
+	for {
+		var h blockHashMsg
+		if err := dec.Decode(&h); err != nil {
+			return err
+		}
+		if h.Done {
+			break
+		}
+		if h.Size < 0 {
+			// Hole extent: clear any stale data unconditionally.
+			if err := punchHole(dst, h.Offset, -h.Size); err != nil {
+				return err
+			}
+			continue
+		}
+
+		block := make([]byte, h.Size)
+		n, err := dst.ReadAt(block, h.Offset)
+		if err != nil && n != int(h.Size) {
+			// Short read (e.g. destination shorter than expected): treat
+			// as mismatched so it gets sent. A block that lands in a hole
+			// reads back as zeros and is compared like any other.
+			if err := enc.Encode(needMsg{Offset: h.Offset, Size: h.Size}); err != nil {
+				return err
+			}
+			continue
+		}
+		if sha256.Sum256(block) != h.Hash {
+			if err := enc.Encode(needMsg{Offset: h.Offset, Size: h.Size}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := enc.Encode(needMsg{Done: true}); err != nil {
+		return err
+	}
+
+	for {
+		var msg extentMsg
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Done {
+			return nil
+		}
+		if err := applyExtent(dst, msg); err != nil {
+			return err
+		}
+	}
+}
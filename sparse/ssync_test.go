@@ -128,6 +128,127 @@ func RandomSync(t *testing.T, size, seed int64) {
 	os.Remove(dstName)
 }
 
+// TestBlockHashSyncPartialChange verifies that SyncFileBlockDiff only
+// transfers the blocks that actually changed between src and dst, rather
+// than the whole data extent.
+func TestBlockHashSyncPartialChange(t *testing.T) {
+	const localhost = "127.0.0.1"
+	const timeout = 10 //seconds
+	var remoteAddr = TCPEndPoint{localhost, 5001}
+	const size = 8 /*MB*/ << 20
+	const blockSize = 64 << 10
+	const mutatedBlocks = 4
+
+	srcName := tempFileName("ssync-bh-src")
+	dstName := tempFileName("ssync-bh-dst")
+	defer os.Remove(srcName)
+	defer os.Remove(dstName)
+
+	r := rand.New(rand.NewSource(42))
+	content := make([]byte, size)
+	r.Read(content)
+	if err := ioutil.WriteFile(srcName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dstName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mutate a handful of blocks in src to simulate a small incremental
+	// change since dst was last synced.
+	mutated := make(map[int64]bool)
+	for len(mutated) < mutatedBlocks {
+		block := int64(r.Intn(size / blockSize))
+		mutated[block] = true
+	}
+	for block := range mutated {
+		content[block*blockSize] ^= 0xFF
+	}
+	if err := ioutil.WriteFile(srcName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	go TestServer(remoteAddr, timeout)
+	info, err := SyncFileBlockDiff(srcName, remoteAddr, dstName, timeout, blockSize)
+	if err != nil {
+		t.Fatal("sync error", err)
+	}
+
+	maxExpected := int64(mutatedBlocks+1) * blockSize // +1 for slack/races on block boundaries
+	if info.BytesSent > maxExpected {
+		t.Fatalf("expected at most %d bytes sent for %d mutated blocks, got %d", maxExpected, mutatedBlocks, info.BytesSent)
+	}
+	if info.BytesSent >= size {
+		t.Fatalf("block-hash sync sent the whole file (%d bytes); expected only the mutated blocks", info.BytesSent)
+	}
+
+	synced, err := ioutil.ReadFile(dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(synced, content) {
+		t.Fatal("dst content does not match src after block-hash sync")
+	}
+}
+
+// TestWriteSparsePunchesLongZeroRuns verifies that WriteSparse turns
+// sufficiently long embedded zero runs into real holes, even though the
+// caller handed it one dense buffer with no layout information of its own.
+func TestWriteSparsePunchesLongZeroRuns(t *testing.T) {
+	const holeThreshold = Blocks
+	const size = 4 * Blocks
+
+	name := tempFileName("ssync-writesparse")
+	defer os.Remove(name)
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i) | 1 // never zero
+	}
+	// Carve out a hole-sized zero run in the second block, and a
+	// too-short one (half a block) in the fourth that should stay data.
+	for i := Blocks; i < 2*Blocks; i++ {
+		data[i] = 0
+	}
+	for i := 3*Blocks + Blocks/4; i < 3*Blocks+3*Blocks/4; i++ {
+		data[i] = 0
+	}
+
+	if err := WriteSparse(f, 0, data, holeThreshold); err != nil {
+		t.Fatal(err)
+	}
+	f.Sync()
+
+	layout, err := RetrieveLayout(f, Interval{0, size})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantHole := Interval{Blocks, 2 * Blocks}
+	found := false
+	for _, extent := range layout {
+		if extent.Kind == SparseHole && extent.Interval == wantHole {
+			found = true
+		}
+		// The short zero run must not have become a hole of its own.
+		if extent.Kind == SparseHole && extent.Begin >= 3*Blocks && extent.Begin < 4*Blocks {
+			t.Fatalf("sub-threshold zero run was punched as a hole: %v", extent)
+		}
+	}
+	if !found {
+		t.Fatalf("expected a hole at %v, got layout %v", wantHole, layout)
+	}
+}
+
 func tempFileName(prefix string) string {
 	// Make a temporary file name
 	f, err := ioutil.TempFile(".", prefix)
@@ -243,7 +364,7 @@ func createTestSparseFileLayout(name string, fileSize int64, layout <-chan TestF
 		for interval := range layout {
 			log.Debug("writing...", interval)
 			if SparseData == interval.Kind {
-				size := batch * Blocks
+				size := int64(batch) * Blocks
 				for offset := interval.Begin; offset < interval.End; {
 					if offset+size > interval.End {
 						size = interval.End - offset
@@ -276,7 +397,7 @@ func checkTestSparseFileLayout(name string, layout <-chan TestFileInterval) erro
 	for interval := range layout {
 		log.Debug("checking...", interval)
 		if SparseData == interval.Kind {
-			size := batch * Blocks
+			size := int64(batch) * Blocks
 			for offset := interval.Begin; offset < interval.End; {
 				if offset+size > interval.End {
 					size = interval.End - offset
@@ -0,0 +1,242 @@
+package sparse
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/sparse-tools/log"
+)
+
+// fileManifestEntry describes one file in a directory tree being synced,
+// enough for the remote side to decide whether it already has an
+// up-to-date copy without reading the file's contents.
+type fileManifestEntry struct {
+	Path         string // slash-separated, relative to the tree root
+	Size         int64
+	Mode         os.FileMode
+	ModTime      time.Time
+	LayoutDigest [sha256.Size]byte
+}
+
+// treeRequest is the first message SyncTree sends: the destination root
+// and a manifest of every regular file under the source root.
+type treeRequest struct {
+	DstDir   string
+	Manifest []fileManifestEntry
+}
+
+// treeResponse lists the manifest paths the server wants synced, in the
+// order both sides will then process them in, one after another, over the
+// same connection.
+type treeResponse struct {
+	Changed []string
+}
+
+// SyncTree synchronizes every regular file under srcDir into the matching
+// path under dstDir on the server listening at addr. Files the server
+// already has an up-to-date copy of (by size, mtime and sparse-layout
+// digest) are skipped entirely; the rest are synced one at a time using
+// the same extent protocol SyncFile uses, multiplexed over a single TCP
+// connection. timeout bounds the dial and the whole session, in seconds.
+func SyncTree(srcDir string, addr TCPEndPoint, dstDir string, timeout int) (map[string]SyncInfo, error) {
+	manifest, err := buildManifest(srcDir)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Duration(timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	if err := enc.Encode(treeRequest{DstDir: dstDir, Manifest: manifest}); err != nil {
+		return nil, err
+	}
+
+	var resp treeResponse
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	log.Info("SyncTree: ", len(resp.Changed), " of ", len(manifest), " files need sync")
+
+	results := make(map[string]SyncInfo, len(resp.Changed))
+	for _, path := range resp.Changed {
+		src, err := os.Open(filepath.Join(srcDir, path))
+		if err != nil {
+			return results, err
+		}
+
+		info, err := syncFileSession(enc, dec, src, filepath.Join(dstDir, path), SyncModeLayout, 0)
+		src.Close()
+		if err != nil {
+			return results, err
+		}
+		results[path] = info
+	}
+
+	return results, nil
+}
+
+// TestTreeServer accepts a single SyncTree session at addr, comparing the
+// client's manifest against the destination root the client names in its
+// request to decide which files need syncing, then serving each of them in
+// turn over the same connection. It exists to exercise SyncTree end to end
+// in tests; production deployments are expected to run their own
+// long-lived listener loop around the same session handling.
+func TestTreeServer(addr TCPEndPoint, timeout int) error {
+	l, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if tl, ok := l.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	var req treeRequest
+	if err := dec.Decode(&req); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(req.DstDir, 0755); err != nil {
+		return err
+	}
+
+	changed, err := filterChanged(req.DstDir, req.Manifest)
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(treeResponse{Changed: changed}); err != nil {
+		return err
+	}
+
+	for range changed {
+		if err := serveFileSession(enc, dec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildManifest walks dir and describes every regular file in it, relative
+// to dir, using slash-separated paths regardless of platform.
+func buildManifest(dir string) ([]fileManifestEntry, error) {
+	var manifest []fileManifestEntry
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		digest, err := layoutDigest(f, fi.Size())
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		manifest = append(manifest, fileManifestEntry{
+			Path:         filepath.ToSlash(rel),
+			Size:         fi.Size(),
+			Mode:         fi.Mode(),
+			ModTime:      fi.ModTime(),
+			LayoutDigest: digest,
+		})
+		return nil
+	})
+
+	return manifest, err
+}
+
+// filterChanged compares manifest entries against the files already
+// present under rootDir and returns the paths that are missing or differ.
+func filterChanged(rootDir string, manifest []fileManifestEntry) ([]string, error) {
+	var changed []string
+
+	for _, entry := range manifest {
+		path := filepath.Join(rootDir, filepath.FromSlash(entry.Path))
+
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			changed = append(changed, entry.Path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() != entry.Size || !fi.ModTime().Equal(entry.ModTime) {
+			changed = append(changed, entry.Path)
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := layoutDigest(f, fi.Size())
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if digest != entry.LayoutDigest {
+			changed = append(changed, entry.Path)
+		}
+	}
+
+	return changed, nil
+}
+
+// layoutDigest hashes a file's sparse layout (its sequence of hole/data
+// extents), not its contents, so that two files with the same shape can be
+// compared cheaply without reading their data.
+func layoutDigest(f *os.File, size int64) ([sha256.Size]byte, error) {
+	layout, err := RetrieveLayout(f, Interval{0, size})
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	h := sha256.New()
+	var buf [17]byte
+	for _, extent := range layout {
+		buf[0] = byte(extent.Kind)
+		binary.BigEndian.PutUint64(buf[1:9], uint64(extent.Begin))
+		binary.BigEndian.PutUint64(buf[9:17], uint64(extent.End))
+		h.Write(buf[:])
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest, nil
+}
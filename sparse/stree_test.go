@@ -0,0 +1,75 @@
+package sparse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/rancher/sparse-tools/sparse"
+)
+
+// TestSyncTree verifies that SyncTree lands every source file under the
+// destination root, and that a second run against an already up-to-date
+// destination has nothing left to do.
+func TestSyncTree(t *testing.T) {
+	const localhost = "127.0.0.1"
+	const timeout = 10 //seconds
+	var remoteAddr = TCPEndPoint{localhost, 5002}
+
+	srcDir, err := ioutil.TempDir(".", "ssync-tree-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir(".", "ssync-tree-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	files := map[string][]byte{
+		"a.img":          []byte("alpha content"),
+		"nested/b.img":   []byte("beta content"),
+		"nested/c.empty": {},
+	}
+	for rel, content := range files {
+		path := filepath.Join(srcDir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go TestTreeServer(remoteAddr, timeout)
+	results, err := SyncTree(srcDir, remoteAddr, dstDir, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("expected %d files synced, got %d", len(files), len(results))
+	}
+
+	for rel, content := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dstDir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(content) {
+			t.Fatalf("%s: expected %q, got %q", rel, content, got)
+		}
+	}
+
+	// A second sync against an already up-to-date destination should find
+	// nothing that needs transferring.
+	go TestTreeServer(remoteAddr, timeout)
+	results, err = SyncTree(srcDir, remoteAddr, dstDir, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("expected no files to need syncing on second pass, got %d", len(results))
+	}
+}
@@ -0,0 +1,60 @@
+package sparse
+
+import "fmt"
+
+// Blocks is the granularity, in bytes, at which sparse-tools reasons about
+// a file's data/hole layout. It matches the common filesystem hole
+// granularity (4KB) rather than any particular disk sector size.
+const Blocks = 4096
+
+// SparseFileKind classifies a FileInterval as either a hole (implicit
+// zeros, no storage backing it) or data (bytes that must be read/written).
+type SparseFileKind int
+
+// The two kinds of extents a sparse file is made of.
+const (
+	SparseHole SparseFileKind = iota
+	SparseData
+)
+
+func (k SparseFileKind) String() string {
+	if k == SparseHole {
+		return "hole"
+	}
+	return "data"
+}
+
+// Interval is a half-open byte range [Begin, End) within a file.
+type Interval struct {
+	Begin int64
+	End   int64
+}
+
+// Len returns the length in bytes of the interval.
+func (i Interval) Len() int64 {
+	return i.End - i.Begin
+}
+
+func (i Interval) String() string {
+	return fmt.Sprintf("[%d:%d)", i.Begin, i.End)
+}
+
+// FileInterval is an Interval tagged with whether it is a hole or data.
+type FileInterval struct {
+	Kind SparseFileKind
+	Interval
+}
+
+func (i FileInterval) String() string {
+	return fmt.Sprintf("{%v %v}", i.Kind, i.Interval)
+}
+
+// TCPEndPoint identifies a sync server to dial or listen on.
+type TCPEndPoint struct {
+	Host string
+	Port int
+}
+
+func (e TCPEndPoint) String() string {
+	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+}
@@ -0,0 +1,119 @@
+package sparse
+
+import (
+	"encoding/gob"
+	"net"
+	"os"
+	"time"
+)
+
+// VerifyFile confirms that remoteName on the server listening at addr
+// matches localName, without writing to either side. Every data extent of
+// localName is hashed with hasher and compared against the same byte
+// range on the remote file; a mismatch is reported as an *IntegrityError.
+// A nil hasher selects DefaultHasher. timeout bounds the dial and the
+// whole session, in seconds.
+func VerifyFile(localName string, addr TCPEndPoint, remoteName string, timeout int, hasher Hasher) error {
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+
+	src, err := os.Open(localName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Duration(timeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	if err := enc.Encode(syncRequest{Name: remoteName, Size: size, Mode: SyncModeVerify, HasherName: hasher.Name()}); err != nil {
+		return err
+	}
+
+	layout, err := RetrieveLayout(src, Interval{0, size})
+	if err != nil {
+		return err
+	}
+	if err := clientVerifySync(src, layout, hasher, enc); err != nil {
+		return err
+	}
+
+	var ack extentMsg
+	if err := dec.Decode(&ack); err != nil {
+		return err
+	}
+	if ack.Integrity != nil {
+		return ack.Integrity
+	}
+	return nil
+}
+
+// clientVerifySync hashes each data extent of src and sends the hash (but
+// never the data itself) to the server for comparison.
+func clientVerifySync(src *os.File, layout []FileInterval, hasher Hasher, enc *gob.Encoder) error {
+	buf := make([]byte, syncChunkSize)
+	for _, extent := range layout {
+		if extent.Kind == SparseHole {
+			continue
+		}
+
+		h := hasher.New()
+		for offset := extent.Begin; offset < extent.End; {
+			size := int64(len(buf))
+			if offset+size > extent.End {
+				size = extent.End - offset
+			}
+			chunk := buf[:size]
+			if _, err := src.ReadAt(chunk, offset); err != nil {
+				return err
+			}
+			h.Write(chunk)
+			offset += size
+		}
+
+		msg := extentMsg{Extent: extent, LastChunk: true, ExtentInterval: extent.Interval, Hash: h.Sum(nil)}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(extentMsg{Done: true})
+}
+
+// serveVerifySync compares each data extent hash the client sends against
+// the matching range already on dst, without writing anything.
+func serveVerifySync(dst *os.File, expectedSize int64, hasher Hasher, dec *gob.Decoder) error {
+	fi, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != expectedSize {
+		return &IntegrityError{Offset: 0, Length: expectedSize}
+	}
+
+	for {
+		var msg extentMsg
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Done {
+			return nil
+		}
+		if err := verifyWritten(dst, hasher, msg.ExtentInterval, msg.Hash); err != nil {
+			return err
+		}
+	}
+}
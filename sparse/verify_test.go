@@ -0,0 +1,60 @@
+package sparse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/rancher/sparse-tools/sparse"
+)
+
+func TestVerifyFileMatches(t *testing.T) {
+	const localhost = "127.0.0.1"
+	const timeout = 10 //seconds
+	remoteAddr := TCPEndPoint{localhost, 5005}
+
+	content := []byte("identical sparse-tools test content")
+	srcName := tempFileName("ssync-verify-src")
+	dstName := tempFileName("ssync-verify-dst")
+	defer os.Remove(srcName)
+	defer os.Remove(dstName)
+
+	if err := ioutil.WriteFile(srcName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dstName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	go TestServer(remoteAddr, timeout)
+	if err := VerifyFile(srcName, remoteAddr, dstName, timeout, nil); err != nil {
+		t.Fatal("expected identical files to verify clean:", err)
+	}
+}
+
+func TestVerifyFileDetectsMismatch(t *testing.T) {
+	const localhost = "127.0.0.1"
+	const timeout = 10 //seconds
+	remoteAddr := TCPEndPoint{localhost, 5006}
+
+	srcName := tempFileName("ssync-verify-src")
+	dstName := tempFileName("ssync-verify-dst")
+	defer os.Remove(srcName)
+	defer os.Remove(dstName)
+
+	if err := ioutil.WriteFile(srcName, []byte("original content, block one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dstName, []byte("corrupted content, block one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	go TestServer(remoteAddr, timeout)
+	err := VerifyFile(srcName, remoteAddr, dstName, timeout, DefaultHasher)
+	if err == nil {
+		t.Fatal("expected verification to fail for mismatched files")
+	}
+	if _, ok := err.(*IntegrityError); !ok {
+		t.Fatalf("expected *IntegrityError, got %T: %v", err, err)
+	}
+}